@@ -5,69 +5,144 @@ package crowdsec_bouncer_traefik_plugin //nolint:revive,stylecheck
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
+	appsec "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/appsec"
 	cache "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/cache"
 	captcha "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/captcha"
 	configuration "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/configuration"
 	ip "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/ip"
 	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+	metrics "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/metrics"
 )
 
+// pluginVersion is reported to LAPI's usage-metrics endpoint.
+const pluginVersion = "dev"
+
 const (
-	crowdsecLapiHeader      = "X-Api-Key"
-	crowdsecCapiHeader      = "Authorization"
-	crowdsecLapiRoute       = "v1/decisions"
-	crowdsecLapiStreamRoute = "v1/decisions/stream"
-	crowdsecCapiLogin       = "v2/watchers/login"
-	crowdsecCapiStreamRoute = "v2/decisions/stream"
-	cacheTimeoutKey         = "updated"
+	crowdsecLapiHeader              = "X-Api-Key"
+	crowdsecCapiHeader              = "Authorization"
+	crowdsecLapiRoute               = "v1/decisions"
+	crowdsecLapiStreamRoute         = "v1/decisions/stream"
+	crowdsecCapiLogin               = "v2/watchers/login"
+	crowdsecCapiStreamRoute         = "v2/decisions/stream"
+	cacheTimeoutKey                 = "updated"
+	blocklistCachePrefix            = "blocklist:"
+	blocklistEtagPrefix             = "blocklist:etag:"
+	blocklistModifiedPrefix         = "blocklist:modified:"
+	blocklistManifestPrefix         = "blocklist:manifest:"
+	crowdsecUnreachablePrefix       = "unreachable:"
+	crowdsecUnreachableCacheSeconds = int64(5)
+	crowdsecLapiLogin               = "v1/watchers/login"
+	crowdsecLapiRegistrationRoute   = "v1/watchers"
+	registrationMachineIDCacheKey   = "registration:machineID"
+	registrationPasswordCacheKey    = "registration:password"
+	crowdsecLapiUsageMetricsRoute   = "v1/usage-metrics"
+	crowdsecLapiHealthCheckRoute    = "v1/decisions"
+	defaultEndpointCooldownSeconds  = int64(30)
 )
 
-//nolint:gochecknoglobals
-var (
-	isStartup               = true
-	isCrowdsecStreamHealthy = true
-	ticker                  chan bool
-)
+// errCrowdsecUnreachable signals that a LAPI call itself failed, as opposed to LAPI
+// answering normally with a ban decision. ServeHTTP uses it to pick between "denied by
+// CrowdSec" and "denied because CrowdSec was down".
+var errCrowdsecUnreachable = errors.New("crowdsec unreachable")
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *configuration.Config {
 	return configuration.New()
 }
 
+// lapiEndpoint is one candidate scheme/host pair for reaching LAPI. Bouncer tries endpoints
+// in slice order and skips ones it recently marked unhealthy, so a single LAPI outage no
+// longer has to blackhole traffic when other endpoints are configured.
+type lapiEndpoint struct {
+	Scheme string
+	Host   string
+
+	mu            sync.Mutex
+	healthy       bool
+	cooldownUntil int64
+}
+
+func newLapiEndpoint(scheme, host string) *lapiEndpoint {
+	return &lapiEndpoint{Scheme: scheme, Host: host, healthy: true}
+}
+
+// available reports whether the endpoint should be tried: either it wasn't marked unhealthy,
+// or its cooldown has elapsed since it was.
+func (e *lapiEndpoint) available() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.healthy || time.Now().Unix() >= e.cooldownUntil
+}
+
+// markResult records the outcome of a request against this endpoint, putting it into a
+// cooldown on failure so it is not retried on every single request.
+func (e *lapiEndpoint) markResult(ok bool, cooldownSeconds int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.healthy = ok
+	if !ok {
+		e.cooldownUntil = time.Now().Unix() + cooldownSeconds
+	}
+}
+
 // Bouncer a Bouncer struct.
 type Bouncer struct {
 	next     http.Handler
 	name     string
 	template *template.Template
 
-	enabled                bool
-	crowdsecScheme         string
-	crowdsecHost           string
-	crowdsecKey            string
-	crowdsecMode           string
-	crowdsecMachineID      string
-	crowdsecPassword       string
-	crowdsecScenarios      []string
-	updateInterval         int64
-	defaultDecisionTimeout int64
-	customHeader           string
-	crowdsecStreamRoute    string
-	crowdsecHeader         string
-	clientPoolStrategy     *ip.PoolStrategy
-	serverPoolStrategy     *ip.PoolStrategy
-	httpClient             *http.Client
-	cacheClient            *cache.Client
-	captchaClient          *captcha.Client
+	enabled                     bool
+	crowdsecScheme              string
+	crowdsecHost                string
+	crowdsecKey                 string
+	crowdsecMode                string
+	crowdsecUnreachableBehavior string
+	mtlsEnabled                 bool
+	appsecUnreachableBehavior   string
+	metricsPushInterval         int64
+	crowdsecMachineID           string
+	crowdsecPassword            string
+	crowdsecScenarios           []string
+	updateInterval              int64
+	defaultDecisionTimeout      int64
+	customHeader                string
+	crowdsecStreamRoute         string
+	crowdsecHeader              string
+	clientPoolStrategy          *ip.PoolStrategy
+	serverPoolStrategy          *ip.PoolStrategy
+	httpClient                  *http.Client
+	cacheClient                 *cache.Client
+	captchaClient               *captcha.Client
+	appsecClient                *appsec.Client
+	metrics                     *metrics.Registry
+
+	lapiEndpoints           []*lapiEndpoint
+	endpointCooldownSeconds int64
+	healthCheckInterval     int64
+	healthCheckRoute        string
+
+	// Per-instance state, previously package-level globals: isStartup/isCrowdsecStreamHealthy/
+	// ticker stomped on each other whenever a Traefik process instantiated more than one
+	// Bouncer (one per router). Keeping them here instead fixes that.
+	isStartup               bool
+	isCrowdsecStreamHealthy bool
+	ticker                  chan bool
+	healthTicker            chan bool
+	metricsTicker           chan bool
 }
 
 // New creates the crowdsec bouncer plugin.
@@ -102,31 +177,44 @@ func New(ctx context.Context, next http.Handler, config *configuration.Config, n
 			return nil, err
 		}
 		apiKey, errAPIKey := configuration.GetVariable(config, "CrowdsecLapiKey")
-		if errAPIKey != nil && len(tlsConfig.Certificates) == 0 {
+		if errAPIKey != nil && len(tlsConfig.Certificates) == 0 && !config.CrowdsecLapiRegistrationEnabled {
 			logger.Error(fmt.Sprintf("New:crowdsecLapiKey fail to get CrowdsecLapiKey and no client certificate setup %s", errAPIKey.Error()))
 			return nil, err
 		}
 		config.CrowdsecLapiKey = apiKey
 	}
 
+	lapiEndpoints := []*lapiEndpoint{newLapiEndpoint(config.CrowdsecLapiScheme, config.CrowdsecLapiHost)}
+	for _, host := range config.CrowdsecLapiHosts {
+		lapiEndpoints = append(lapiEndpoints, newLapiEndpoint(config.CrowdsecLapiScheme, host))
+	}
+	endpointCooldownSeconds := config.CrowdsecLapiEndpointCooldownSeconds
+	if endpointCooldownSeconds <= 0 {
+		endpointCooldownSeconds = defaultEndpointCooldownSeconds
+	}
+
 	bouncer := &Bouncer{
 		next:     next,
 		name:     name,
 		template: template.New("CrowdsecBouncer").Delims("[[", "]]"),
 
-		enabled:                config.Enabled,
-		crowdsecMode:           config.CrowdsecMode,
-		crowdsecScheme:         config.CrowdsecLapiScheme,
-		crowdsecHost:           config.CrowdsecLapiHost,
-		crowdsecKey:            config.CrowdsecLapiKey,
-		crowdsecMachineID:      config.CrowdsecCapiMachineID,
-		crowdsecPassword:       config.CrowdsecCapiPassword,
-		crowdsecScenarios:      config.CrowdsecCapiScenarios,
-		updateInterval:         config.UpdateIntervalSeconds,
-		customHeader:           config.ForwardedHeadersCustomName,
-		defaultDecisionTimeout: config.DefaultDecisionSeconds,
-		crowdsecStreamRoute:    crowdsecStreamRoute,
-		crowdsecHeader:         crowdsecHeader,
+		enabled:                     config.Enabled,
+		crowdsecMode:                config.CrowdsecMode,
+		crowdsecUnreachableBehavior: config.CrowdsecUnreachableBehavior,
+		crowdsecScheme:              config.CrowdsecLapiScheme,
+		crowdsecHost:                config.CrowdsecLapiHost,
+		crowdsecKey:                 config.CrowdsecLapiKey,
+		crowdsecMachineID:           config.CrowdsecCapiMachineID,
+		crowdsecPassword:            config.CrowdsecCapiPassword,
+		crowdsecScenarios:           config.CrowdsecCapiScenarios,
+		updateInterval:              config.UpdateIntervalSeconds,
+		customHeader:                config.ForwardedHeadersCustomName,
+		defaultDecisionTimeout:      config.DefaultDecisionSeconds,
+		crowdsecStreamRoute:         crowdsecStreamRoute,
+		crowdsecHeader:              crowdsecHeader,
+		mtlsEnabled:                 tlsConfig != nil && len(tlsConfig.Certificates) > 0,
+		appsecUnreachableBehavior:   config.AppsecUnreachableBehavior,
+		metricsPushInterval:         config.MetricsRemotePushInterval,
 		serverPoolStrategy: &ip.PoolStrategy{
 			Checker: serverChecker,
 		},
@@ -143,6 +231,15 @@ func New(ctx context.Context, next http.Handler, config *configuration.Config, n
 		},
 		cacheClient:   &cache.Client{},
 		captchaClient: &captcha.Client{},
+		appsecClient:  &appsec.Client{},
+		metrics:       metrics.Get(name),
+
+		lapiEndpoints:           lapiEndpoints,
+		endpointCooldownSeconds: endpointCooldownSeconds,
+		healthCheckInterval:     config.CrowdsecLapiHealthCheckIntervalSeconds,
+		healthCheckRoute:        config.CrowdsecLapiHealthRoute,
+		isStartup:               true,
+		isCrowdsecStreamHealthy: true,
 	}
 	config.RedisCachePassword, _ = configuration.GetVariable(config, "RedisCachePassword")
 	bouncer.cacheClient.New(
@@ -165,16 +262,48 @@ func New(ctx context.Context, next http.Handler, config *configuration.Config, n
 
 	bouncer.captchaClient.Cache = bouncer.cacheClient //Reuse the same cache client for captcha
 
-	if (config.CrowdsecMode == configuration.StreamMode || config.CrowdsecMode == configuration.AloneMode) && ticker == nil {
+	bouncer.appsecClient.New(
+		config.AppsecEnabled,
+		config.AppsecScheme,
+		config.AppsecHost,
+		config.AppsecKey,
+		config.AppsecFailureMode,
+		config.AppsecBodyMaxSizeKB,
+		0,
+	)
+
+	if config.MetricsEnabled {
+		bouncer.metrics.Serve(fmt.Sprintf(":%d", config.MetricsPort), config.MetricsPath)
+		if config.MetricsRemotePushInterval > 0 {
+			bouncer.metricsTicker = startTicker(time.Duration(config.MetricsRemotePushInterval)*time.Second, func() {
+				pushUsageMetrics(bouncer)
+			})
+		}
+	}
+
+	if config.CrowdsecMode != configuration.AloneMode && bouncer.healthCheckInterval > 0 && len(bouncer.lapiEndpoints) > 1 {
+		bouncer.healthTicker = startTicker(time.Duration(bouncer.healthCheckInterval)*time.Second, func() {
+			checkEndpointsHealth(bouncer)
+		})
+	}
+
+	if config.CrowdsecMode != configuration.AloneMode && bouncer.crowdsecKey == "" && !bouncer.mtlsEnabled && config.CrowdsecLapiRegistrationEnabled {
+		if err := registerBouncer(bouncer); err != nil {
+			logger.Error(fmt.Sprintf("New:registerBouncer %s", err.Error()))
+			return nil, err
+		}
+	}
+
+	if config.CrowdsecMode == configuration.StreamMode || config.CrowdsecMode == configuration.AloneMode {
 		if config.CrowdsecMode == configuration.AloneMode {
-			if err := getToken(bouncer); err != nil {
+			if err := getToken(bouncer, crowdsecCapiLogin); err != nil {
 				logger.Error(fmt.Sprintf("New:getToken %s", err.Error()))
 				return nil, err
 			}
 		}
 		handleStreamTicker(bouncer)
-		isStartup = false
-		ticker = startTicker(config, func() {
+		bouncer.isStartup = false
+		bouncer.ticker = startTicker(time.Duration(config.UpdateIntervalSeconds)*time.Second, func() {
 			handleStreamTicker(bouncer)
 		})
 	}
@@ -183,6 +312,23 @@ func New(ctx context.Context, next http.Handler, config *configuration.Config, n
 	return bouncer, nil
 }
 
+// Close stops every ticker goroutine this Bouncer started in New. Traefik never calls this
+// itself today, but without it each config reload's New leaked the previous instance's
+// ticker/healthTicker/metricsTicker goroutines, piling up redundant LAPI polling over time.
+// Callers that recreate a Bouncer (e.g. tests, or a future reload hook) should call Close on
+// the old instance first.
+func (bouncer *Bouncer) Close() {
+	for _, stop := range []chan bool{bouncer.ticker, bouncer.healthTicker, bouncer.metricsTicker} {
+		if stop == nil {
+			continue
+		}
+		select {
+		case stop <- true:
+		default:
+		}
+	}
+}
+
 // ServeHTTP principal function of plugin.
 //
 //nolint:nestif
@@ -208,6 +354,7 @@ func (bouncer *Bouncer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// if our IP is in the trusted list we bypass the next checks
 	logger.Debug(fmt.Sprintf("ServeHTTP ip:%s isTrusted:%v", remoteIP, isTrusted))
 	if isTrusted {
+		bouncer.metrics.IncProcessed(metrics.DecisionBypass)
 		bouncer.next.ServeHTTP(rw, req)
 		return
 	}
@@ -219,11 +366,15 @@ func (bouncer *Bouncer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			errString := cacheErr.Error()
 			logger.Debug(fmt.Sprintf("ServeHTTP:getDecision ip:%s isBanned:false %s", remoteIP, errString))
 			if errString != cache.CacheMiss {
-				logger.Error(fmt.Sprintf("ServeHTTP:getDecision ip:%s %s", remoteIP, errString))
-				rw.WriteHeader(http.StatusForbidden)
+				logger.Error(fmt.Sprintf("ServeHTTP:getDecision ip:%s crowdsecUnreachable:true %s", remoteIP, errString))
+				bouncer.metrics.IncCacheOperation("get", "error")
+				bouncer.metrics.IncProcessed(metrics.DecisionError)
+				handleUnreachable(bouncer, remoteIP, rw, req)
 				return
 			}
+			bouncer.metrics.IncCacheOperation("get", "miss")
 		} else {
+			bouncer.metrics.IncCacheOperation("get", "hit")
 			handleRemediation(remoteIP, remediation, bouncer, rw, req)
 			return
 		}
@@ -231,19 +382,46 @@ func (bouncer *Bouncer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	// Right here if we cannot join the stream we forbid the request to go on.
 	if bouncer.crowdsecMode == configuration.StreamMode || bouncer.crowdsecMode == configuration.AloneMode {
-		if isCrowdsecStreamHealthy {
-			bouncer.next.ServeHTTP(rw, req)
+		if bouncer.isCrowdsecStreamHealthy {
+			serveNext(bouncer, remoteIP, rw, req)
 		} else {
-			logger.Debug(fmt.Sprintf("ServeHTTP isCrowdsecStreamHealthy:false ip:%s", remoteIP))
-			rw.WriteHeader(http.StatusForbidden)
+			logger.Debug(fmt.Sprintf("ServeHTTP isCrowdsecStreamHealthy:false ip:%s crowdsecUnreachable:true", remoteIP))
+			bouncer.metrics.IncProcessed(metrics.DecisionError)
+			handleUnreachable(bouncer, remoteIP, rw, req)
 		}
 	} else {
-		//TODO handle error
-		remediation, _ := handleNoStreamCache(bouncer, remoteIP)
+		remediation, err := handleNoStreamCache(bouncer, remoteIP)
+		if errors.Is(err, errCrowdsecUnreachable) {
+			logger.Error(fmt.Sprintf("ServeHTTP:handleNoStreamCache ip:%s crowdsecUnreachable:true %s", remoteIP, err.Error()))
+			bouncer.metrics.IncProcessed(metrics.DecisionError)
+			handleUnreachable(bouncer, remoteIP, rw, req)
+			return
+		}
 		handleRemediation(remoteIP, remediation, bouncer, rw, req)
 	}
 }
 
+// handleUnreachable applies the operator-configured CrowdsecUnreachableBehavior (deny, allow or
+// captcha) for requests that cannot be evaluated because CrowdSec itself is unreachable, keeping
+// that decision distinct in the logs from an actual CrowdSec-issued ban.
+func handleUnreachable(bouncer *Bouncer, remoteIP string, rw http.ResponseWriter, req *http.Request) {
+	handleUnreachableAs(bouncer, bouncer.crowdsecUnreachableBehavior, remoteIP, rw, req)
+}
+
+// handleUnreachableAs applies a configured unreachable-behavior (deny, allow or captcha) for
+// a remoteIP, used both when CrowdSec itself is unreachable and when AppSec is unreachable.
+func handleUnreachableAs(bouncer *Bouncer, behavior, remoteIP string, rw http.ResponseWriter, req *http.Request) {
+	logger.Debug(fmt.Sprintf("handleUnreachableAs ip:%s behavior:%s", remoteIP, behavior))
+	switch behavior {
+	case configuration.UnreachableAllow:
+		bouncer.next.ServeHTTP(rw, req)
+	case configuration.UnreachableCaptcha:
+		handleRemediation(remoteIP, cache.CaptchaValue, bouncer, rw, req)
+	default:
+		rw.WriteHeader(http.StatusForbidden)
+	}
+}
+
 // CUSTOM CODE.
 // TODO place in another file.
 
@@ -263,6 +441,21 @@ type Decision struct {
 type Stream struct {
 	Deleted []Decision `json:"deleted"`
 	New     []Decision `json:"new"`
+	Links   Links      `json:"links"`
+}
+
+// Links holds the CAPI third-party resources advertised alongside a stream response.
+type Links struct {
+	Blocklists []Blocklist `json:"blocklists"`
+}
+
+// Blocklist a community-curated, plain-text one-IP-per-line blocklist advertised by CAPI.
+type Blocklist struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Scope       string `json:"scope"`
+	Remediation string `json:"remediation"`
+	Duration    string `json:"duration"`
 }
 
 // Login Body returned from Crowdsec Login CAPI.
@@ -279,31 +472,125 @@ func handleRemediation(remoteIP, remediation string, bouncer *Bouncer, rw http.R
 	}
 	switch remediation {
 	case cache.BannedValue:
+		bouncer.metrics.IncProcessed(metrics.DecisionBan)
 		rw.WriteHeader(http.StatusForbidden)
 		return
 	case cache.CaptchaValue:
 		logger.Debug(fmt.Sprintf("handleRemediation ip:%s remediation:captcha", remoteIP))
 		//Check if request path is not favicon
 		if !bouncer.captchaClient.CheckCookie(rw, req) && req.URL.Path != "/favicon.ico" {
+			bouncer.metrics.IncProcessed(metrics.DecisionCaptcha)
 			bouncer.captchaClient.ServeHTTP(rw, req, remoteIP)
 			return
 		}
 	}
 	logger.Debug(fmt.Sprintf("handleRemediation ip:%s remediation:pass", remoteIP))
-	bouncer.next.ServeHTTP(rw, req)
+	serveNext(bouncer, remoteIP, rw, req)
+}
+
+// serveNext forwards the request to bouncer.next, first submitting it to AppSec (WAF)
+// inspection when configured. This runs only once the IP allowlist/decision checks above
+// have already cleared the request.
+func serveNext(bouncer *Bouncer, remoteIP string, rw http.ResponseWriter, req *http.Request) {
+	if bouncer.appsecClient == nil || !bouncer.appsecClient.Enabled {
+		bouncer.metrics.IncProcessed(metrics.DecisionAllow)
+		bouncer.next.ServeHTTP(rw, req)
+		return
+	}
+
+	verdict, err := bouncer.appsecClient.Query(req, remoteIP)
+	if err != nil {
+		logger.Error(fmt.Sprintf("serveNext:appsecQuery ip:%s %s", remoteIP, err.Error()))
+		if errors.Is(err, appsec.ErrBodyTooLarge) {
+			if bouncer.appsecClient.FailureMode == configuration.AppsecFailureModeBlock {
+				bouncer.metrics.IncProcessed(metrics.DecisionBan)
+				rw.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			bouncer.metrics.IncProcessed(metrics.DecisionAllow)
+			bouncer.next.ServeHTTP(rw, req)
+			return
+		}
+		bouncer.metrics.IncProcessed(metrics.DecisionError)
+		handleUnreachableAs(bouncer, bouncer.appsecUnreachableBehavior, remoteIP, rw, req)
+		return
+	}
+
+	switch verdict.Action {
+	case appsec.Allow:
+		bouncer.metrics.IncProcessed(metrics.DecisionAllow)
+		bouncer.next.ServeHTTP(rw, req)
+	case appsec.Deny:
+		bouncer.metrics.IncProcessed(metrics.DecisionBan)
+		status := verdict.HTTPStatus
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		rw.WriteHeader(status)
+	case appsec.Captcha:
+		// Serve the captcha challenge directly rather than routing back through
+		// handleRemediation/serveNext, which would re-query AppSec on the fallthrough.
+		if !bouncer.captchaClient.CheckCookie(rw, req) && req.URL.Path != "/favicon.ico" {
+			bouncer.metrics.IncProcessed(metrics.DecisionCaptcha)
+			bouncer.captchaClient.ServeHTTP(rw, req, remoteIP)
+			return
+		}
+		bouncer.metrics.IncProcessed(metrics.DecisionAllow)
+		bouncer.next.ServeHTTP(rw, req)
+	default:
+		// An unrecognized or empty action is not a safe "allow": treat it the same as an
+		// AppSec-unreachable error instead of silently letting the request through.
+		logger.Error(fmt.Sprintf("serveNext:unknownAction ip:%s action:%q", remoteIP, verdict.Action))
+		bouncer.metrics.IncProcessed(metrics.DecisionError)
+		handleUnreachableAs(bouncer, bouncer.appsecUnreachableBehavior, remoteIP, rw, req)
+	}
 }
 
 func handleStreamTicker(bouncer *Bouncer) {
 	if err := handleStreamCache(bouncer); err != nil {
-		isCrowdsecStreamHealthy = false
+		bouncer.isCrowdsecStreamHealthy = false
 		logger.Error(err.Error())
 	} else {
-		isCrowdsecStreamHealthy = true
+		bouncer.isCrowdsecStreamHealthy = true
+	}
+}
+
+// checkEndpointsHealth actively probes every configured LAPI endpoint and updates its
+// healthy bit, so a downed endpoint is detected even before a decision query would have hit
+// it, and a recovered endpoint can be brought back out of cooldown promptly.
+func checkEndpointsHealth(bouncer *Bouncer) {
+	route := bouncer.healthCheckRoute
+	if route == "" {
+		route = crowdsecLapiHealthCheckRoute
+	}
+	for _, endpoint := range bouncer.lapiEndpoints {
+		healthURL := url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host, Path: route, RawQuery: "ip=127.0.0.1"}
+		req, err := http.NewRequest(http.MethodGet, healthURL.String(), nil)
+		if err != nil {
+			continue
+		}
+		if bouncer.crowdsecKey != "" || !bouncer.mtlsEnabled {
+			req.Header.Add(bouncer.crowdsecHeader, bouncer.crowdsecKey)
+		}
+		res, err := bouncer.httpClient.Do(req)
+		if err != nil {
+			endpoint.markResult(false, bouncer.endpointCooldownSeconds)
+			logger.Debug(fmt.Sprintf("checkEndpointsHealth:unhealthy host:%s %s", endpoint.Host, err.Error()))
+			continue
+		}
+		healthy := res.StatusCode < http.StatusInternalServerError
+		if errClose := res.Body.Close(); errClose != nil {
+			logger.Error(fmt.Sprintf("checkEndpointsHealth:closeBody %s", errClose.Error()))
+		}
+		endpoint.markResult(healthy, bouncer.endpointCooldownSeconds)
+		if !healthy {
+			logger.Debug(fmt.Sprintf("checkEndpointsHealth:unhealthy host:%s statusCode:%d", endpoint.Host, res.StatusCode))
+		}
 	}
 }
 
-func startTicker(config *configuration.Config, work func()) chan bool {
-	ticker := time.NewTicker(time.Duration(config.UpdateIntervalSeconds) * time.Second)
+func startTicker(interval time.Duration, work func()) chan bool {
+	ticker := time.NewTicker(interval)
 	stop := make(chan bool, 1)
 	go func() {
 		defer logger.Debug("ticker:stopped")
@@ -323,20 +610,23 @@ func startTicker(config *configuration.Config, work func()) chan bool {
 func handleNoStreamCache(bouncer *Bouncer, remoteIP string) (string, error) {
 	value := cache.NoBannedValue
 	isLiveMode := bouncer.crowdsecMode == configuration.LiveMode
-	routeURL := url.URL{
-		Scheme:   bouncer.crowdsecScheme,
-		Host:     bouncer.crowdsecHost,
-		Path:     crowdsecLapiRoute,
-		RawQuery: fmt.Sprintf("ip=%v&banned=true", remoteIP),
+
+	// Avoid hammering a downed LAPI: if we already marked this remote IP as unreachable
+	// recently, skip straight to the unreachable behavior without querying again.
+	if _, err := bouncer.cacheClient.Get(crowdsecUnreachablePrefix + remoteIP); err == nil {
+		return value, errCrowdsecUnreachable
 	}
-	body, err := crowdsecQuery(bouncer, routeURL.String(), false)
+
+	body, err := crowdsecQuery(bouncer, crowdsecLapiRoute, fmt.Sprintf("ip=%v&banned=true", remoteIP), false)
 	if err != nil {
-		return value, err
+		bouncer.cacheClient.Set(crowdsecUnreachablePrefix+remoteIP, cache.NoBannedValue, crowdsecUnreachableCacheSeconds)
+		return value, fmt.Errorf("%w: %s", errCrowdsecUnreachable, err.Error())
 	}
 
 	if bytes.Equal(body, []byte("null")) {
 		if isLiveMode {
 			bouncer.cacheClient.Set(remoteIP, value, bouncer.defaultDecisionTimeout)
+			bouncer.metrics.IncCacheOperation("set", "decision")
 		}
 		return value, nil
 	}
@@ -349,6 +639,7 @@ func handleNoStreamCache(bouncer *Bouncer, remoteIP string) (string, error) {
 	if len(decisions) == 0 {
 		if isLiveMode {
 			bouncer.cacheClient.Set(remoteIP, value, bouncer.defaultDecisionTimeout)
+			bouncer.metrics.IncCacheOperation("set", "decision")
 		}
 		return value, nil
 	}
@@ -378,24 +669,20 @@ func handleNoStreamCache(bouncer *Bouncer, remoteIP string) (string, error) {
 			logger.Debug(fmt.Sprintf("handleStreamCache:unknownType %s", decision.Type))
 		}
 		bouncer.cacheClient.Set(remoteIP, value, durationSecond)
+		bouncer.metrics.IncCacheOperation("set", "decision")
 	}
 	return value, fmt.Errorf("handleNoStreamCache:banned")
 }
 
-func getToken(bouncer *Bouncer) error {
-	loginURL := url.URL{
-		Scheme: bouncer.crowdsecScheme,
-		Host:   bouncer.crowdsecHost,
-		Path:   crowdsecCapiLogin,
-	}
-	body, err := crowdsecQuery(bouncer, loginURL.String(), true)
+func getToken(bouncer *Bouncer, loginRoute string) error {
+	body, err := crowdsecQuery(bouncer, loginRoute, "", true)
 	if err != nil {
 		return err
 	}
 	var login Login
 	err = json.Unmarshal(body, &login)
 	if err != nil {
-		isCrowdsecStreamHealthy = false
+		bouncer.isCrowdsecStreamHealthy = false
 		return fmt.Errorf("getToken:parsingBody %w", err)
 	}
 	if login.Code == 200 && len(login.Token) > 0 {
@@ -406,27 +693,107 @@ func getToken(bouncer *Bouncer) error {
 	return fmt.Errorf("getToken statusCode:%d", login.Code)
 }
 
+// registerBouncer auto-registers the bouncer against LAPI when neither an API key nor a
+// client certificate is configured. It generates a machine ID/password pair, persists them
+// in cacheClient so restarts reuse the same identity, posts them to the watcher registration
+// route, then exchanges them for a LAPI token used as bouncer.crowdsecKey on subsequent calls.
+func registerBouncer(bouncer *Bouncer) error {
+	// Namespace the cache keys by bouncer name so several bouncer instances sharing one cache
+	// backend (e.g. Redis) don't register with the same machine ID/password pair.
+	machineIDCacheKey := bouncer.name + ":" + registrationMachineIDCacheKey
+	passwordCacheKey := bouncer.name + ":" + registrationPasswordCacheKey
+
+	machineID, err := bouncer.cacheClient.Get(machineIDCacheKey)
+	if err != nil {
+		if machineID, err = generateRegistrationSecret(); err != nil {
+			return fmt.Errorf("registerBouncer:generateMachineID %w", err)
+		}
+		bouncer.cacheClient.Set(machineIDCacheKey, machineID, 0)
+	}
+	password, err := bouncer.cacheClient.Get(passwordCacheKey)
+	if err != nil {
+		if password, err = generateRegistrationSecret(); err != nil {
+			return fmt.Errorf("registerBouncer:generatePassword %w", err)
+		}
+		bouncer.cacheClient.Set(passwordCacheKey, password, 0)
+	}
+	bouncer.crowdsecMachineID = machineID
+	bouncer.crowdsecPassword = password
+
+	if _, err := crowdsecQuery(bouncer, crowdsecLapiRegistrationRoute, "", true); err != nil {
+		return fmt.Errorf("registerBouncer:register %w", err)
+	}
+	if err := getToken(bouncer, crowdsecLapiLogin); err != nil {
+		return fmt.Errorf("registerBouncer:login %w", err)
+	}
+	logger.Info(fmt.Sprintf("registerBouncer:registered machineID:%s", machineID))
+	return nil
+}
+
+// generateRegistrationSecret returns a random hex-encoded secret suitable for use as a
+// machine ID or password in the auto-registration flow.
+func generateRegistrationSecret() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generateRegistrationSecret %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
 func handleStreamCache(bouncer *Bouncer) error {
 	// TODO clean properly on exit.
 	// Instead of blocking the goroutine interval for all the secondary node,
 	// if the master service is shut down, other goroutine can take the lead
 	// because updated routine information is in the cache
-	_, err := bouncer.cacheClient.Get(cacheTimeoutKey)
-	if err == nil {
-		logger.Debug("handleStreamCache:alreadyUpdated")
-		return nil
-	}
-	if err.Error() != cache.CacheMiss {
-		return err
+	//
+	// Each LAPI endpoint gets its own cacheTimeoutKey suffix, so with several endpoints
+	// configured a shared (e.g. Redis-backed) cacheClient still lets multiple bouncer
+	// instances split the fetch work instead of every instance re-fetching every endpoint.
+	anyHealthy := false
+	var firstErr error
+	for _, endpoint := range bouncer.lapiEndpoints {
+		if !endpoint.available() {
+			logger.Debug(fmt.Sprintf("handleStreamCache:skipCooldown host:%s", endpoint.Host))
+			continue
+		}
+		timeoutKey := cacheTimeoutKey + ":" + endpoint.Host
+		if _, err := bouncer.cacheClient.Get(timeoutKey); err == nil {
+			logger.Debug(fmt.Sprintf("handleStreamCache:alreadyUpdated host:%s", endpoint.Host))
+			anyHealthy = true
+			continue
+		} else if err.Error() != cache.CacheMiss {
+			logger.Error(fmt.Sprintf("handleStreamCache:cache host:%s %s", endpoint.Host, err.Error()))
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		bouncer.cacheClient.Set(timeoutKey, cache.NoBannedValue, bouncer.updateInterval-1)
+		if err := handleStreamCacheEndpoint(bouncer, endpoint); err != nil {
+			logger.Error(fmt.Sprintf("handleStreamCache:endpoint host:%s %s", endpoint.Host, err.Error()))
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		anyHealthy = true
 	}
-	bouncer.cacheClient.Set(cacheTimeoutKey, cache.NoBannedValue, bouncer.updateInterval-1)
-	streamRouteURL := url.URL{
-		Scheme:   bouncer.crowdsecScheme,
-		Host:     bouncer.crowdsecHost,
-		Path:     bouncer.crowdsecStreamRoute,
-		RawQuery: fmt.Sprintf("startup=%t", !isCrowdsecStreamHealthy || isStartup),
+	if !anyHealthy {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("handleStreamCache: all lapi endpoints in cooldown")
+		}
+		return firstErr
 	}
-	body, err := crowdsecQuery(bouncer, streamRouteURL.String(), false)
+	logger.Debug("handleStreamCache:updated")
+	bouncer.isCrowdsecStreamHealthy = true
+	bouncer.metrics.SetStreamLastSuccess(time.Now().Unix())
+	return nil
+}
+
+// handleStreamCacheEndpoint fetches and applies one LAPI endpoint's decision stream.
+func handleStreamCacheEndpoint(bouncer *Bouncer, endpoint *lapiEndpoint) error {
+	rawQuery := fmt.Sprintf("startup=%t", !bouncer.isCrowdsecStreamHealthy || bouncer.isStartup)
+	body, err := crowdsecQueryEndpoint(bouncer, endpoint, bouncer.crowdsecStreamRoute, rawQuery, false)
 	if err != nil {
 		return err
 	}
@@ -435,6 +802,7 @@ func handleStreamCache(bouncer *Bouncer) error {
 	if err != nil {
 		return fmt.Errorf("handleStreamCache:parsingBody %w", err)
 	}
+	activeDecisions := map[string]int64{}
 	for _, decision := range stream.New {
 		duration, err := time.ParseDuration(decision.Duration)
 		if err == nil {
@@ -448,17 +816,162 @@ func handleStreamCache(bouncer *Bouncer) error {
 				logger.Debug(fmt.Sprintf("handleStreamCache:unknownType %s", decision.Type))
 			}
 			bouncer.cacheClient.Set(decision.Value, value, int64(duration.Seconds()))
+			bouncer.metrics.IncCacheOperation("set", "decision")
+			activeDecisions[decision.Origin+"|"+decision.Scope]++
 		}
 	}
+	for originScope, count := range activeDecisions {
+		origin, scope, _ := strings.Cut(originScope, "|")
+		bouncer.metrics.SetActiveDecisions(origin, scope, count)
+	}
 	for _, decision := range stream.Deleted {
 		bouncer.cacheClient.Delete(decision.Value)
+		bouncer.metrics.IncCacheOperation("delete", "decision")
 	}
-	logger.Debug("handleStreamCache:updated")
-	isCrowdsecStreamHealthy = true
+	for _, blocklist := range stream.Links.Blocklists {
+		if err := handleBlocklist(bouncer, blocklist); err != nil {
+			logger.Error(fmt.Sprintf("handleStreamCache:blocklist name:%s %s", blocklist.Name, err.Error()))
+		}
+	}
+	return nil
+}
+
+// handleBlocklist fetches a single CAPI third-party blocklist and mirrors its entries into
+// cacheClient under a name-prefixed key, using conditional GET (ETag/Last-Modified) so an
+// unchanged blocklist is not re-downloaded every UpdateIntervalSeconds tick.
+func handleBlocklist(bouncer *Bouncer, blocklist Blocklist) error {
+	duration, err := time.ParseDuration(blocklist.Duration)
+	if err != nil {
+		return fmt.Errorf("handleBlocklist:parseDuration name:%s %w", blocklist.Name, err)
+	}
+
+	headers := map[string]string{}
+	etagKey := blocklistEtagPrefix + blocklist.URL
+	if etag, errCache := bouncer.cacheClient.Get(etagKey); errCache == nil {
+		headers["If-None-Match"] = etag
+	}
+	modifiedKey := blocklistModifiedPrefix + blocklist.URL
+	if modified, errCache := bouncer.cacheClient.Get(modifiedKey); errCache == nil {
+		headers["If-Modified-Since"] = modified
+	}
+
+	body, statusCode, resHeaders, err := crowdsecBlocklistQuery(bouncer, blocklist.URL, headers)
+	if err != nil {
+		return fmt.Errorf("handleBlocklist:query name:%s %w", blocklist.Name, err)
+	}
+	if statusCode == http.StatusNotModified {
+		logger.Debug(fmt.Sprintf("handleBlocklist:notModified name:%s", blocklist.Name))
+		return nil
+	}
+
+	value := cache.BannedValue
+	if blocklist.Remediation == "captcha" {
+		value = cache.CaptchaValue
+	}
+	durationSecond := int64(duration.Seconds())
+	entryPrefix := blocklistCachePrefix + blocklist.Name + ":"
+
+	var previousIPs []string
+	manifestKey := blocklistManifestPrefix + blocklist.Name
+	if manifest, errCache := bouncer.cacheClient.Get(manifestKey); errCache == nil {
+		_ = json.Unmarshal([]byte(manifest), &previousIPs)
+	}
+
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(body), "\n") {
+		remoteIP := strings.TrimSpace(line)
+		if remoteIP == "" || strings.HasPrefix(remoteIP, "#") {
+			continue
+		}
+		seen[remoteIP] = true
+		bouncer.cacheClient.Set(entryPrefix+remoteIP, value, durationSecond)
+	}
+	for _, previousIP := range previousIPs {
+		if !seen[previousIP] {
+			bouncer.cacheClient.Delete(entryPrefix + previousIP)
+		}
+	}
+
+	currentIPs := make([]string, 0, len(seen))
+	for remoteIP := range seen {
+		currentIPs = append(currentIPs, remoteIP)
+	}
+	if manifest, errMarshal := json.Marshal(currentIPs); errMarshal == nil {
+		bouncer.cacheClient.Set(manifestKey, string(manifest), bouncer.updateInterval*10)
+	}
+	if etag := resHeaders.Get("ETag"); etag != "" {
+		bouncer.cacheClient.Set(etagKey, etag, bouncer.updateInterval*10)
+	}
+	if modified := resHeaders.Get("Last-Modified"); modified != "" {
+		bouncer.cacheClient.Set(modifiedKey, modified, bouncer.updateInterval*10)
+	}
+	logger.Debug(fmt.Sprintf("handleBlocklist:updated name:%s count:%d", blocklist.Name, len(seen)))
 	return nil
 }
 
-func crowdsecQuery(bouncer *Bouncer, stringURL string, isPost bool) ([]byte, error) {
+// crowdsecBlocklistQuery fetches a third-party blocklist URL, optionally sending conditional-GET
+// headers. Unlike crowdsecQuery it treats 304 Not Modified as success rather than failure, and it
+// does not send the crowdsec api key header since blocklist URLs are plain external resources.
+func crowdsecBlocklistQuery(bouncer *Bouncer, stringURL string, headers map[string]string) ([]byte, int, http.Header, error) {
+	req, err := http.NewRequest(http.MethodGet, stringURL, nil)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("crowdsecBlocklistQuery:newRequest url:%s %w", stringURL, err)
+	}
+	for key, value := range headers {
+		req.Header.Add(key, value)
+	}
+	res, err := bouncer.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("crowdsecBlocklistQuery url:%s %w", stringURL, err)
+	}
+	defer func() {
+		if errClose := res.Body.Close(); errClose != nil {
+			logger.Error(fmt.Sprintf("crowdsecBlocklistQuery:closeBody %s", errClose.Error()))
+		}
+	}()
+	if res.StatusCode == http.StatusNotModified {
+		return nil, res.StatusCode, res.Header, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, res.StatusCode, nil, fmt.Errorf("crowdsecBlocklistQuery url:%s, statusCode:%d", stringURL, res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, res.StatusCode, nil, fmt.Errorf("crowdsecBlocklistQuery:readBody %w", err)
+	}
+	return body, res.StatusCode, res.Header, nil
+}
+
+// crowdsecQuery tries bouncer.lapiEndpoints in priority order, skipping ones currently in
+// their failure cooldown, and returns the first successful response. This is what lets a
+// single LAPI outage fail over to another configured endpoint instead of denying everything.
+func crowdsecQuery(bouncer *Bouncer, path, rawQuery string, isPost bool) ([]byte, error) {
+	var lastErr error
+	attempted := false
+	for _, endpoint := range bouncer.lapiEndpoints {
+		if !endpoint.available() {
+			continue
+		}
+		attempted = true
+		body, err := crowdsecQueryEndpoint(bouncer, endpoint, path, rawQuery, isPost)
+		if err == nil {
+			return body, nil
+		}
+		lastErr = err
+	}
+	if !attempted && len(bouncer.lapiEndpoints) > 0 {
+		// Every endpoint is in its cooldown: try the first one anyway rather than failing
+		// outright, since the active health check may not have run since it was marked down.
+		return crowdsecQueryEndpoint(bouncer, bouncer.lapiEndpoints[0], path, rawQuery, isPost)
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("crowdsecQuery path:%s: no lapi endpoint configured", path)
+	}
+	return nil, lastErr
+}
+
+func crowdsecQueryEndpoint(bouncer *Bouncer, endpoint *lapiEndpoint, path, rawQuery string, isPost bool) ([]byte, error) {
+	stringURL := (&url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host, Path: path, RawQuery: rawQuery}).String()
 	var req *http.Request
 	if isPost {
 		data := []byte(fmt.Sprintf(
@@ -471,16 +984,31 @@ func crowdsecQuery(bouncer *Bouncer, stringURL string, isPost bool) ([]byte, err
 	} else {
 		req, _ = http.NewRequest(http.MethodGet, stringURL, nil)
 	}
-	req.Header.Add(bouncer.crowdsecHeader, bouncer.crowdsecKey)
+	// When mTLS is configured and no API key was issued, rely on the client certificate
+	// handshake for authentication instead of sending an empty X-Api-Key header, which
+	// some LAPI configurations reject outright.
+	if bouncer.crowdsecKey != "" || !bouncer.mtlsEnabled {
+		req.Header.Add(bouncer.crowdsecHeader, bouncer.crowdsecKey)
+	}
+	route := req.URL.Path
+	start := time.Now()
 	res, err := bouncer.httpClient.Do(req)
+	bouncer.metrics.ObserveLapiDuration(time.Since(start).Seconds())
 	if err != nil {
+		bouncer.metrics.IncLapiRequest(route, 0)
+		endpoint.markResult(false, bouncer.endpointCooldownSeconds)
 		return nil, fmt.Errorf("crowdsecQuery url:%s %w", stringURL, err)
 	}
+	bouncer.metrics.IncLapiRequest(route, res.StatusCode)
 	if res.StatusCode == http.StatusUnauthorized && bouncer.crowdsecMode == configuration.AloneMode {
-		if errToken := getToken(bouncer); errToken != nil {
+		if errToken := getToken(bouncer, crowdsecCapiLogin); errToken != nil {
 			return nil, fmt.Errorf("crowdsecQuery:renewToken url:%s %w", stringURL, errToken)
 		}
-		return crowdsecQuery(bouncer, stringURL, false)
+		return crowdsecQueryEndpoint(bouncer, endpoint, path, rawQuery, false)
+	}
+	if res.StatusCode >= http.StatusInternalServerError {
+		endpoint.markResult(false, bouncer.endpointCooldownSeconds)
+		return nil, fmt.Errorf("crowdsecQuery url:%s, statusCode:%d", stringURL, res.StatusCode)
 	}
 	if res.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("crowdsecQuery url:%s, statusCode:%d", stringURL, res.StatusCode)
@@ -495,5 +1023,46 @@ func crowdsecQuery(bouncer *Bouncer, stringURL string, isPost bool) ([]byte, err
 	if err != nil {
 		return nil, fmt.Errorf("crowdsecQuery:readBody %w", err)
 	}
+	endpoint.markResult(true, 0)
 	return body, nil
 }
+
+// pushUsageMetrics reports this bouncer's aggregated counters to LAPI's /v1/usage-metrics
+// route, in the JSON schema CrowdSec expects from remote_metrics pushes.
+func pushUsageMetrics(bouncer *Bouncer) {
+	payload := bouncer.metrics.BuildUsagePayload(pluginVersion, bouncer.metricsPushInterval, []string{bouncer.crowdsecMode})
+	data, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error(fmt.Sprintf("pushUsageMetrics:marshal %s", err.Error()))
+		return
+	}
+	usageURL := url.URL{
+		Scheme: bouncer.crowdsecScheme,
+		Host:   bouncer.crowdsecHost,
+		Path:   crowdsecLapiUsageMetricsRoute,
+	}
+	req, err := http.NewRequest(http.MethodPost, usageURL.String(), bytes.NewBuffer(data))
+	if err != nil {
+		logger.Error(fmt.Sprintf("pushUsageMetrics:newRequest %s", err.Error()))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if bouncer.crowdsecKey != "" || !bouncer.mtlsEnabled {
+		req.Header.Add(bouncer.crowdsecHeader, bouncer.crowdsecKey)
+	}
+	res, err := bouncer.httpClient.Do(req)
+	if err != nil {
+		logger.Error(fmt.Sprintf("pushUsageMetrics:do %s", err.Error()))
+		return
+	}
+	defer func() {
+		if errClose := res.Body.Close(); errClose != nil {
+			logger.Error(fmt.Sprintf("pushUsageMetrics:closeBody %s", errClose.Error()))
+		}
+	}()
+	if res.StatusCode != http.StatusOK {
+		logger.Error(fmt.Sprintf("pushUsageMetrics statusCode:%d", res.StatusCode))
+		return
+	}
+	logger.Debug("pushUsageMetrics:pushed")
+}
@@ -0,0 +1,147 @@
+package crowdsec_bouncer_traefik_plugin //nolint:revive,stylecheck
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	appsec "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/appsec"
+	cache "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/cache"
+	captcha "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/captcha"
+	configuration "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/configuration"
+	metrics "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/metrics"
+)
+
+func newTestAppsecBouncer(t *testing.T, appsecServerURL string) *Bouncer {
+	t.Helper()
+	name := t.Name()
+	bouncer := &Bouncer{
+		name:                      name,
+		next:                      http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusTeapot) }),
+		cacheClient:               &cache.Client{},
+		captchaClient:             &captcha.Client{},
+		appsecClient:              &appsec.Client{},
+		appsecUnreachableBehavior: configuration.UnreachableDeny,
+		metrics:                   metrics.Get(name),
+	}
+	bouncer.cacheClient.New(false, "", "", "0")
+	_ = bouncer.captchaClient.New("", "", "", "", "", "ban", 0)
+	bouncer.captchaClient.Cache = bouncer.cacheClient
+
+	scheme, host := "http", appsecServerURL
+	if parsed, err := url.Parse(appsecServerURL); err == nil && parsed.Host != "" {
+		scheme, host = parsed.Scheme, parsed.Host
+	}
+	bouncer.appsecClient.New(true, scheme, host, "key", configuration.AppsecFailureModeBlock, 64, 10)
+	return bouncer
+}
+
+func newTestServeNextRequest(t *testing.T) (*httptest.ResponseRecorder, *http.Request) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	if err != nil {
+		t.Fatalf("newRequest: %v", err)
+	}
+	return httptest.NewRecorder(), req
+}
+
+func TestServeNextAllow(t *testing.T) {
+	appsecServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"action":"allow"}`))
+	}))
+	defer appsecServer.Close()
+
+	bouncer := newTestAppsecBouncer(t, appsecServer.URL)
+	rw, req := newTestServeNextRequest(t)
+	serveNext(bouncer, "127.0.0.1", rw, req)
+	if rw.Code != http.StatusTeapot {
+		t.Fatalf("expected request forwarded to bouncer.next (418), got %d", rw.Code)
+	}
+}
+
+func TestServeNextDeny(t *testing.T) {
+	appsecServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"action":"deny","http_status":403}`))
+	}))
+	defer appsecServer.Close()
+
+	bouncer := newTestAppsecBouncer(t, appsecServer.URL)
+	rw, req := newTestServeNextRequest(t)
+	serveNext(bouncer, "127.0.0.1", rw, req)
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 on deny verdict, got %d", rw.Code)
+	}
+}
+
+func TestServeNextCaptcha(t *testing.T) {
+	appsecServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"action":"captcha"}`))
+	}))
+	defer appsecServer.Close()
+
+	bouncer := newTestAppsecBouncer(t, appsecServer.URL)
+	rw, req := newTestServeNextRequest(t)
+	serveNext(bouncer, "127.0.0.1", rw, req)
+	if rw.Code == http.StatusTeapot {
+		t.Fatalf("expected a captcha challenge rather than a pass-through to bouncer.next")
+	}
+}
+
+func TestServeNextBodyTooLargeFallsThroughPerFailureMode(t *testing.T) {
+	appsecServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"action":"allow"}`))
+	}))
+	defer appsecServer.Close()
+
+	bouncer := newTestAppsecBouncer(t, appsecServer.URL)
+	bouncer.appsecClient.BodyMaxSizeKB = 0 // any non-empty body now exceeds the cap
+	bouncer.appsecClient.FailureMode = configuration.AppsecFailureModeAllow
+
+	rw := httptest.NewRecorder()
+	req, err := http.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("a body"))
+	if err != nil {
+		t.Fatalf("newRequest: %v", err)
+	}
+	serveNext(bouncer, "127.0.0.1", rw, req)
+	if rw.Code != http.StatusTeapot {
+		t.Fatalf("expected AppsecFailureModeAllow to forward to bouncer.next (418), got %d", rw.Code)
+	}
+}
+
+// TestServeNextUnreachableAppliesConfiguredBehavior asserts that when AppSec itself cannot
+// be reached, serveNext applies appsecUnreachableBehavior rather than failing open.
+func TestServeNextUnreachableAppliesConfiguredBehavior(t *testing.T) {
+	bouncer := newTestAppsecBouncer(t, "http://127.0.0.1:1") // nothing listens here
+	bouncer.appsecUnreachableBehavior = configuration.UnreachableDeny
+
+	rw, req := newTestServeNextRequest(t)
+	serveNext(bouncer, "127.0.0.1", rw, req)
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 when AppSec is unreachable and behavior is deny, got %d", rw.Code)
+	}
+}
+
+// TestServeNextUnknownActionAppliesUnreachableBehavior asserts that an unrecognized AppSec
+// verdict action is treated like an AppSec-unreachable error rather than an implicit allow.
+func TestServeNextUnknownActionAppliesUnreachableBehavior(t *testing.T) {
+	appsecServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"action":"something-new"}`))
+	}))
+	defer appsecServer.Close()
+
+	bouncer := newTestAppsecBouncer(t, appsecServer.URL)
+	bouncer.appsecUnreachableBehavior = configuration.UnreachableDeny
+
+	rw, req := newTestServeNextRequest(t)
+	serveNext(bouncer, "127.0.0.1", rw, req)
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("expected an unknown action to be denied (appsecUnreachableBehavior), got %d", rw.Code)
+	}
+}
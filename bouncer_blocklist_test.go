@@ -0,0 +1,117 @@
+package crowdsec_bouncer_traefik_plugin //nolint:revive,stylecheck
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cache "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/cache"
+	metrics "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/metrics"
+)
+
+func newTestBlocklistBouncer(t *testing.T) *Bouncer {
+	t.Helper()
+	bouncer := &Bouncer{
+		name:           "test-blocklist",
+		httpClient:     &http.Client{},
+		cacheClient:    &cache.Client{},
+		updateInterval: 60,
+		metrics:        metrics.Get("test-blocklist"),
+	}
+	bouncer.cacheClient.New(false, "", "", "0")
+	return bouncer
+}
+
+// TestHandleBlocklistFirstFetchPopulatesCache asserts a first fetch stores every entry
+// from the blocklist body under the blocklist's name-prefixed cache key.
+func TestHandleBlocklistFirstFetchPopulatesCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("1.2.3.4\n5.6.7.8\n"))
+	}))
+	defer server.Close()
+
+	bouncer := newTestBlocklistBouncer(t)
+	blocklist := Blocklist{Name: "community", URL: server.URL, Remediation: "ban", Duration: "1h"}
+
+	if err := handleBlocklist(bouncer, blocklist); err != nil {
+		t.Fatalf("handleBlocklist: %v", err)
+	}
+	for _, remoteIP := range []string{"1.2.3.4", "5.6.7.8"} {
+		if value, err := bouncer.cacheClient.Get(blocklistCachePrefix + "community:" + remoteIP); err != nil || value != cache.BannedValue {
+			t.Fatalf("expected %s to be cached as banned, got value:%q err:%v", remoteIP, value, err)
+		}
+	}
+}
+
+// TestHandleBlocklistNotModifiedKeepsEntries asserts a 304 response (conditional GET hit)
+// leaves the previously-inserted entries untouched and is not treated as an error.
+func TestHandleBlocklistNotModifiedKeepsEntries(t *testing.T) {
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if requestCount == 1 {
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("1.2.3.4\n"))
+			return
+		}
+		if r.Header.Get("If-None-Match") != `"v1"` {
+			t.Errorf("expected If-None-Match %q on second fetch, got %q", `"v1"`, r.Header.Get("If-None-Match"))
+		}
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	bouncer := newTestBlocklistBouncer(t)
+	blocklist := Blocklist{Name: "community", URL: server.URL, Remediation: "ban", Duration: "1h"}
+
+	if err := handleBlocklist(bouncer, blocklist); err != nil {
+		t.Fatalf("handleBlocklist(first): %v", err)
+	}
+	if err := handleBlocklist(bouncer, blocklist); err != nil {
+		t.Fatalf("handleBlocklist(second, 304): %v", err)
+	}
+	if value, err := bouncer.cacheClient.Get(blocklistCachePrefix + "community:1.2.3.4"); err != nil || value != cache.BannedValue {
+		t.Fatalf("expected 1.2.3.4 to remain cached after a 304, got value:%q err:%v", value, err)
+	}
+}
+
+// TestHandleBlocklistChangedBodyAddsAndRemovesEntries asserts that when the blocklist body
+// changes, entries no longer present are pruned and newly-added ones are cached.
+func TestHandleBlocklistChangedBodyAddsAndRemovesEntries(t *testing.T) {
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, requestCount))
+		w.WriteHeader(http.StatusOK)
+		if requestCount == 1 {
+			_, _ = w.Write([]byte("1.2.3.4\n5.6.7.8\n"))
+			return
+		}
+		_, _ = w.Write([]byte("1.2.3.4\n9.9.9.9\n"))
+	}))
+	defer server.Close()
+
+	bouncer := newTestBlocklistBouncer(t)
+	blocklist := Blocklist{Name: "community", URL: server.URL, Remediation: "ban", Duration: "1h"}
+
+	if err := handleBlocklist(bouncer, blocklist); err != nil {
+		t.Fatalf("handleBlocklist(first): %v", err)
+	}
+	if err := handleBlocklist(bouncer, blocklist); err != nil {
+		t.Fatalf("handleBlocklist(second): %v", err)
+	}
+
+	if _, err := bouncer.cacheClient.Get(blocklistCachePrefix + "community:5.6.7.8"); err == nil {
+		t.Fatalf("expected 5.6.7.8 to have been pruned after it disappeared from the blocklist")
+	}
+	if value, err := bouncer.cacheClient.Get(blocklistCachePrefix + "community:9.9.9.9"); err != nil || value != cache.BannedValue {
+		t.Fatalf("expected 9.9.9.9 to be cached as banned, got value:%q err:%v", value, err)
+	}
+	if value, err := bouncer.cacheClient.Get(blocklistCachePrefix + "community:1.2.3.4"); err != nil || value != cache.BannedValue {
+		t.Fatalf("expected 1.2.3.4 to remain cached, got value:%q err:%v", value, err)
+	}
+}
@@ -0,0 +1,150 @@
+package crowdsec_bouncer_traefik_plugin //nolint:revive,stylecheck
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cache "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/cache"
+	metrics "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/metrics"
+)
+
+// generateTestCertificate returns a self-signed certificate/key pair, used as both the
+// server certificate and the bouncer's client certificate so the handshake stays self-contained.
+func generateTestCertificate(t *testing.T, organizationalUnit string) tls.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generateTestCertificate:generateKey %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bouncer", OrganizationalUnit: []string{organizationalUnit}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("generateTestCertificate:createCertificate %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("generateTestCertificate:x509KeyPair %v", err)
+	}
+	return cert
+}
+
+func newTestBouncer(t *testing.T, name string) *Bouncer {
+	t.Helper()
+	bouncer := &Bouncer{
+		name:           name,
+		crowdsecHeader: crowdsecLapiHeader,
+		httpClient:     &http.Client{},
+		cacheClient:    &cache.Client{},
+		metrics:        metrics.Get(name),
+	}
+	bouncer.cacheClient.New(false, "", "", "0")
+	return bouncer
+}
+
+// TestCrowdsecQueryEndpointSkipsAPIKeyHeaderWhenMTLSEnabled asserts that once a client
+// certificate authenticates the connection, an empty X-Api-Key header is not also sent --
+// some LAPI configurations reject requests carrying an empty auth header outright.
+func TestCrowdsecQueryEndpointSkipsAPIKeyHeaderWhenMTLSEnabled(t *testing.T) {
+	cert := generateTestCertificate(t, "bouncers-ou")
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parseCertificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	var gotHeader []string
+	var gotOU []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Values(crowdsecLapiHeader)
+		if len(r.TLS.PeerCertificates) > 0 {
+			gotOU = r.TLS.PeerCertificates[0].Subject.OrganizationalUnit
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("null"))
+	}))
+	server.TLS = &tls.Config{ //nolint:gosec
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	bouncer := newTestBouncer(t, "test-mtls")
+	bouncer.mtlsEnabled = true
+	bouncer.httpClient = server.Client()
+	transport := bouncer.httpClient.Transport.(*http.Transport)
+	transport.TLSClientConfig.RootCAs = pool
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+	endpoint := newLapiEndpoint("https", server.Listener.Addr().String())
+	if _, err := crowdsecQueryEndpoint(bouncer, endpoint, crowdsecLapiRoute, "ip=127.0.0.1", false); err != nil {
+		t.Fatalf("crowdsecQueryEndpoint: %v", err)
+	}
+	if len(gotOU) == 0 || gotOU[0] != "bouncers-ou" {
+		t.Fatalf("expected the server to see client certificate OU %q, got %v", "bouncers-ou", gotOU)
+	}
+	if len(gotHeader) != 0 {
+		t.Fatalf("expected no %s header with mTLS enabled and no key, got %q", crowdsecLapiHeader, gotHeader)
+	}
+}
+
+// TestRegisterBouncerNamespacesCredentialsByName asserts that two bouncers with different
+// names sharing one cacheClient register with distinct machine IDs, so they can't collide
+// on a shared cache backend.
+func TestRegisterBouncerNamespacesCredentialsByName(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+crowdsecLapiRegistrationRoute {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"code":200,"token":"test-token"}`))
+	}))
+	defer server.Close()
+
+	shared := &cache.Client{}
+	shared.New(false, "", "", "0")
+
+	first := newTestBouncer(t, "router-a")
+	first.cacheClient = shared
+	first.httpClient = server.Client()
+	first.lapiEndpoints = []*lapiEndpoint{newLapiEndpoint("http", server.Listener.Addr().String())}
+
+	second := newTestBouncer(t, "router-b")
+	second.cacheClient = shared
+	second.httpClient = server.Client()
+	second.lapiEndpoints = []*lapiEndpoint{newLapiEndpoint("http", server.Listener.Addr().String())}
+
+	if err := registerBouncer(first); err != nil {
+		t.Fatalf("registerBouncer(first): %v", err)
+	}
+	if err := registerBouncer(second); err != nil {
+		t.Fatalf("registerBouncer(second): %v", err)
+	}
+	if first.crowdsecMachineID == second.crowdsecMachineID {
+		t.Fatalf("expected distinct machine IDs for differently-named bouncers, got %q for both", first.crowdsecMachineID)
+	}
+}
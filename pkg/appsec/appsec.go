@@ -0,0 +1,127 @@
+// Package appsec forwards HTTP requests to a CrowdSec AppSec (WAF) component and returns
+// its per-request verdict, alongside the existing IP-decision check done against LAPI.
+package appsec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+)
+
+// Possible values of Response.Action.
+const (
+	Allow   = "allow"
+	Deny    = "deny"
+	Captcha = "captcha"
+)
+
+const queryTimeout = 2 * time.Second
+
+// defaultBodyMaxSizeKB is used when BodyMaxSizeKB is left unset (<= 0), so a zero-value
+// config doesn't silently reject every non-empty request body as too large.
+const defaultBodyMaxSizeKB = int64(128)
+
+// ErrBodyTooLarge is returned by Query when the request body exceeds BodyMaxSizeKB.
+var ErrBodyTooLarge = errors.New("appsec: request body exceeds BodyMaxSizeKB")
+
+// Response is the per-request verdict returned by the CrowdSec AppSec component.
+type Response struct {
+	Action        string `json:"action"`
+	HTTPStatus    int    `json:"http_status"`
+	BouncerStatus int    `json:"bouncer_status"`
+}
+
+// Client talks to a CrowdSec AppSec component.
+type Client struct {
+	Enabled       bool
+	FailureMode   string
+	BodyMaxSizeKB int64
+
+	appsecURL  string
+	key        string
+	httpClient *http.Client
+	inFlight   chan struct{}
+}
+
+// New configures the AppSec client. maxInFlight bounds the number of requests forwarded to
+// AppSec concurrently, so a slow AppSec cannot pile up goroutines on the Traefik side.
+func (c *Client) New(enabled bool, scheme, host, key, failureMode string, bodyMaxSizeKB int64, maxInFlight int) {
+	c.Enabled = enabled
+	c.FailureMode = failureMode
+	if bodyMaxSizeKB <= 0 {
+		bodyMaxSizeKB = defaultBodyMaxSizeKB
+	}
+	c.BodyMaxSizeKB = bodyMaxSizeKB
+	c.key = key
+	c.appsecURL = (&url.URL{Scheme: scheme, Host: host}).String()
+	c.httpClient = &http.Client{Timeout: queryTimeout}
+	if maxInFlight <= 0 {
+		maxInFlight = 10
+	}
+	c.inFlight = make(chan struct{}, maxInFlight)
+}
+
+// Query mirrors req onto the AppSec endpoint via X-Crowdsec-Appsec-* headers and a capped,
+// teed copy of the body, then returns the parsed verdict. req.Body is replaced with a
+// reusable reader so bouncer.next can still read it afterwards on an allow verdict.
+func (c *Client) Query(req *http.Request, remoteIP string) (*Response, error) {
+	select {
+	case c.inFlight <- struct{}{}:
+		defer func() { <-c.inFlight }()
+	default:
+		return nil, fmt.Errorf("appsec:query too many in-flight requests")
+	}
+
+	// Read the whole body, not just a BodyMaxSizeKB-capped prefix: callers falling through to
+	// bouncer.next on ErrBodyTooLarge (per AppsecFailureMode) must see the full original body,
+	// and a truncated read here would silently corrupt it instead.
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("appsec:query readBody %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	if int64(len(data)) > c.BodyMaxSizeKB*1024 {
+		return nil, ErrBodyTooLarge
+	}
+
+	appsecReq, err := http.NewRequest(http.MethodPost, c.appsecURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("appsec:query newRequest %w", err)
+	}
+	appsecReq.Header.Set("X-Crowdsec-Appsec-Ip", remoteIP)
+	appsecReq.Header.Set("X-Crowdsec-Appsec-Verb", req.Method)
+	appsecReq.Header.Set("X-Crowdsec-Appsec-Uri", req.URL.RequestURI())
+	appsecReq.Header.Set("X-Crowdsec-Appsec-Host", req.Host)
+	appsecReq.Header.Set("X-Crowdsec-Appsec-User-Agent", req.UserAgent())
+	appsecReq.Header.Set("X-Crowdsec-Appsec-Api-Key", c.key)
+
+	res, err := c.httpClient.Do(appsecReq)
+	if err != nil {
+		return nil, fmt.Errorf("appsec:query do %w", err)
+	}
+	defer func() {
+		if errClose := res.Body.Close(); errClose != nil {
+			logger.Error(fmt.Sprintf("appsec:query closeBody %s", errClose.Error()))
+		}
+	}()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("appsec:query statusCode:%d", res.StatusCode)
+	}
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("appsec:query readResponse %w", err)
+	}
+	var verdict Response
+	if err := json.Unmarshal(resBody, &verdict); err != nil {
+		return nil, fmt.Errorf("appsec:query parseResponse %w", err)
+	}
+	return &verdict, nil
+}
@@ -0,0 +1,104 @@
+package appsec
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestRequest(t *testing.T, body string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/path", io.NopCloser(strings.NewReader(body)))
+	if err != nil {
+		t.Fatalf("newTestRequest: %v", err)
+	}
+	return req
+}
+
+func TestQueryAllow(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"action":"allow"}`))
+	}))
+	defer server.Close()
+
+	client := &Client{}
+	client.New(true, "http", server.Listener.Addr().String(), "key", "block", 1, 10)
+
+	req := newTestRequest(t, "body")
+	verdict, err := client.Query(req, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if verdict.Action != Allow {
+		t.Fatalf("expected action %q, got %q", Allow, verdict.Action)
+	}
+}
+
+func TestQueryDeny(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"action":"deny","http_status":403}`))
+	}))
+	defer server.Close()
+
+	client := &Client{}
+	client.New(true, "http", server.Listener.Addr().String(), "key", "block", 1, 10)
+
+	verdict, err := client.Query(newTestRequest(t, "body"), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if verdict.Action != Deny || verdict.HTTPStatus != http.StatusForbidden {
+		t.Fatalf("expected deny/403, got %+v", verdict)
+	}
+}
+
+func TestQueryCaptcha(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"action":"captcha"}`))
+	}))
+	defer server.Close()
+
+	client := &Client{}
+	client.New(true, "http", server.Listener.Addr().String(), "key", "block", 1, 10)
+
+	verdict, err := client.Query(newTestRequest(t, "body"), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if verdict.Action != Captcha {
+		t.Fatalf("expected action %q, got %q", Captcha, verdict.Action)
+	}
+}
+
+func TestQueryBodyTooLargeRestoresBody(t *testing.T) {
+	client := &Client{}
+	client.New(true, "http", "unused", "key", "block", 1, 10)
+
+	body := strings.Repeat("a", 2000)
+	req := newTestRequest(t, body)
+	_, err := client.Query(req, "127.0.0.1")
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("expected ErrBodyTooLarge, got %v", err)
+	}
+	restored, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("reading restored body: %v", err)
+	}
+	if string(restored) != body {
+		t.Fatalf("expected req.Body to be fully restored after a too-large verdict, got %d bytes", len(restored))
+	}
+}
+
+func TestNewDefaultsBodyMaxSizeKB(t *testing.T) {
+	client := &Client{}
+	client.New(true, "http", "unused", "key", "block", 0, 10)
+	if client.BodyMaxSizeKB <= 0 {
+		t.Fatalf("expected BodyMaxSizeKB to default to a positive value, got %d", client.BodyMaxSizeKB)
+	}
+}
@@ -0,0 +1,188 @@
+// Package configuration defines the plugin's dynamic configuration (the Traefik
+// middleware's CreateConfig struct) along with the defaulting, validation and
+// secret-resolution helpers bouncer.go relies on.
+package configuration
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// CrowdsecMode values.
+const (
+	NoneMode   = "none"
+	LiveMode   = "live"
+	StreamMode = "stream"
+	AloneMode  = "alone"
+)
+
+// CrowdsecUnreachableBehavior values, applied when CrowdSec itself cannot be reached.
+const (
+	UnreachableDeny    = "deny"
+	UnreachableAllow   = "allow"
+	UnreachableCaptcha = "captcha"
+)
+
+// AppsecFailureMode values, applied when the request body exceeds AppsecBodyMaxSizeKB. Other
+// AppSec query failures are handled by AppsecUnreachableBehavior.
+const (
+	AppsecFailureModeBlock = "block"
+	AppsecFailureModeAllow = "allow"
+)
+
+// Config the plugin configuration.
+type Config struct {
+	Enabled  bool   `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	LogLevel string `json:"logLevel,omitempty" yaml:"logLevel,omitempty"`
+
+	CrowdsecMode          string   `json:"crowdsecMode,omitempty" yaml:"crowdsecMode,omitempty"`
+	CrowdsecLapiScheme    string   `json:"crowdsecLapiScheme,omitempty" yaml:"crowdsecLapiScheme,omitempty"`
+	CrowdsecLapiHost      string   `json:"crowdsecLapiHost,omitempty" yaml:"crowdsecLapiHost,omitempty"`
+	CrowdsecLapiKey       string   `json:"crowdsecLapiKey,omitempty" yaml:"crowdsecLapiKey,omitempty"`
+	CrowdsecCapiMachineID string   `json:"crowdsecCapiMachineId,omitempty" yaml:"crowdsecCapiMachineId,omitempty"`
+	CrowdsecCapiPassword  string   `json:"crowdsecCapiPassword,omitempty" yaml:"crowdsecCapiPassword,omitempty"`
+	CrowdsecCapiScenarios []string `json:"crowdsecCapiScenarios,omitempty" yaml:"crowdsecCapiScenarios,omitempty"`
+
+	UpdateIntervalSeconds  int64 `json:"updateIntervalSeconds,omitempty" yaml:"updateIntervalSeconds,omitempty"`
+	DefaultDecisionSeconds int64 `json:"defaultDecisionSeconds,omitempty" yaml:"defaultDecisionSeconds,omitempty"`
+	HTTPTimeoutSeconds     int64 `json:"httpTimeoutSeconds,omitempty" yaml:"httpTimeoutSeconds,omitempty"`
+
+	ForwardedHeadersTrustedIPs []string `json:"forwardedHeadersTrustedIps,omitempty" yaml:"forwardedHeadersTrustedIps,omitempty"`
+	ForwardedHeadersCustomName string   `json:"forwardedHeadersCustomName,omitempty" yaml:"forwardedHeadersCustomName,omitempty"`
+	ClientTrustedIPs           []string `json:"clientTrustedIps,omitempty" yaml:"clientTrustedIps,omitempty"`
+
+	// CrowdsecUnreachableBehavior controls the fallback (deny, allow or captcha) applied when
+	// CrowdSec itself cannot be reached, so a LAPI outage doesn't have to take the whole site down.
+	CrowdsecUnreachableBehavior string `json:"crowdsecUnreachableBehavior,omitempty" yaml:"crowdsecUnreachableBehavior,omitempty"`
+
+	// CrowdsecLapiRegistrationEnabled lets the bouncer auto-register against LAPI with a
+	// generated machine ID/password when neither an API key nor a client certificate is set.
+	CrowdsecLapiRegistrationEnabled bool `json:"crowdsecLapiRegistrationEnabled,omitempty" yaml:"crowdsecLapiRegistrationEnabled,omitempty"`
+
+	// mTLS settings for authenticating to LAPI with a client certificate instead of (or in
+	// addition to) an API key, matching LAPI's bouncers_allowed_ou OU-scoped auth model.
+	CrowdsecLapiTLSInsecureVerify       bool   `json:"crowdsecLapiTlsInsecureVerify,omitempty" yaml:"crowdsecLapiTlsInsecureVerify,omitempty"`
+	CrowdsecLapiTLSCertificateBouncer   string `json:"crowdsecLapiTlsCertificateBouncer,omitempty" yaml:"crowdsecLapiTlsCertificateBouncer,omitempty"`
+	CrowdsecLapiTLSKeyBouncer           string `json:"crowdsecLapiTlsKeyBouncer,omitempty" yaml:"crowdsecLapiTlsKeyBouncer,omitempty"`
+	CrowdsecLapiTLSCertificateAuthority string `json:"crowdsecLapiTlsCertificateAuthority,omitempty" yaml:"crowdsecLapiTlsCertificateAuthority,omitempty"`
+
+	RedisCacheEnabled  bool   `json:"redisCacheEnabled,omitempty" yaml:"redisCacheEnabled,omitempty"`
+	RedisCacheHost     string `json:"redisCacheHost,omitempty" yaml:"redisCacheHost,omitempty"`
+	RedisCachePassword string `json:"redisCachePassword,omitempty" yaml:"redisCachePassword,omitempty"`
+	RedisCacheDatabase string `json:"redisCacheDatabase,omitempty" yaml:"redisCacheDatabase,omitempty"`
+
+	CaptchaProvider     string `json:"captchaProvider,omitempty" yaml:"captchaProvider,omitempty"`
+	CaptchaSiteKey      string `json:"captchaSiteKey,omitempty" yaml:"captchaSiteKey,omitempty"`
+	CaptchaSecretKey    string `json:"captchaSecretKey,omitempty" yaml:"captchaSecretKey,omitempty"`
+	CaptchaTemplate     string `json:"captchaTemplate,omitempty" yaml:"captchaTemplate,omitempty"`
+	CaptchaTemplateFile string `json:"captchaTemplateFile,omitempty" yaml:"captchaTemplateFile,omitempty"`
+	CaptchaGracePeriod  int64  `json:"captchaGracePeriodSeconds,omitempty" yaml:"captchaGracePeriodSeconds,omitempty"`
+	FallbackRemediation string `json:"fallbackRemediation,omitempty" yaml:"fallbackRemediation,omitempty"`
+
+	// AppSec (WAF) forwarding: when enabled, cleared requests are additionally forwarded to a
+	// CrowdSec AppSec component for full-request inspection.
+	AppsecEnabled             bool   `json:"appsecEnabled,omitempty" yaml:"appsecEnabled,omitempty"`
+	AppsecScheme              string `json:"appsecScheme,omitempty" yaml:"appsecScheme,omitempty"`
+	AppsecHost                string `json:"appsecHost,omitempty" yaml:"appsecHost,omitempty"`
+	AppsecKey                 string `json:"appsecKey,omitempty" yaml:"appsecKey,omitempty"`
+	AppsecFailureMode         string `json:"appsecFailureMode,omitempty" yaml:"appsecFailureMode,omitempty"`
+	AppsecUnreachableBehavior string `json:"appsecUnreachableBehavior,omitempty" yaml:"appsecUnreachableBehavior,omitempty"`
+	AppsecBodyMaxSizeKB       int64  `json:"appsecBodyMaxSizeKb,omitempty" yaml:"appsecBodyMaxSizeKb,omitempty"`
+
+	// Prometheus metrics scrape endpoint and periodic LAPI usage-metrics push.
+	MetricsEnabled            bool   `json:"metricsEnabled,omitempty" yaml:"metricsEnabled,omitempty"`
+	MetricsPort               int    `json:"metricsPort,omitempty" yaml:"metricsPort,omitempty"`
+	MetricsPath               string `json:"metricsPath,omitempty" yaml:"metricsPath,omitempty"`
+	MetricsRemotePushInterval int64  `json:"metricsRemotePushIntervalSeconds,omitempty" yaml:"metricsRemotePushIntervalSeconds,omitempty"`
+
+	// CrowdsecLapiHosts lists additional LAPI endpoints (scheme taken from
+	// CrowdsecLapiScheme) tried after CrowdsecLapiHost, so an outage of the primary LAPI can
+	// fail over instead of blackholing traffic.
+	CrowdsecLapiHosts []string `json:"crowdsecLapiHosts,omitempty" yaml:"crowdsecLapiHosts,omitempty"`
+	// CrowdsecLapiEndpointCooldownSeconds is how long a failed endpoint is skipped before
+	// being retried.
+	CrowdsecLapiEndpointCooldownSeconds int64 `json:"crowdsecLapiEndpointCooldownSeconds,omitempty" yaml:"crowdsecLapiEndpointCooldownSeconds,omitempty"`
+	// CrowdsecLapiHealthCheckIntervalSeconds enables an active health-check goroutine (when >
+	// 0 and more than one endpoint is configured) against CrowdsecLapiHealthRoute.
+	CrowdsecLapiHealthCheckIntervalSeconds int64  `json:"crowdsecLapiHealthCheckIntervalSeconds,omitempty" yaml:"crowdsecLapiHealthCheckIntervalSeconds,omitempty"`
+	CrowdsecLapiHealthRoute                string `json:"crowdsecLapiHealthRoute,omitempty" yaml:"crowdsecLapiHealthRoute,omitempty"`
+}
+
+// New creates the default plugin configuration.
+func New() *Config {
+	return &Config{
+		Enabled:                     true,
+		LogLevel:                    "INFO",
+		CrowdsecMode:                LiveMode,
+		CrowdsecLapiScheme:          "http",
+		UpdateIntervalSeconds:       60,
+		DefaultDecisionSeconds:      60,
+		HTTPTimeoutSeconds:          10,
+		RedisCacheDatabase:          "0",
+		FallbackRemediation:         "ban",
+		CrowdsecUnreachableBehavior: UnreachableDeny,
+		AppsecFailureMode:           AppsecFailureModeBlock,
+		AppsecUnreachableBehavior:   UnreachableDeny,
+		MetricsPort:                9090,
+		MetricsPath:                "/metrics",
+	}
+}
+
+// ValidateParams validates the plugin configuration.
+func ValidateParams(config *Config) error {
+	switch config.CrowdsecMode {
+	case NoneMode, LiveMode, StreamMode, AloneMode:
+	default:
+		return fmt.Errorf("crowdsecMode must be one of %q, %q, %q or %q, got %q", NoneMode, LiveMode, StreamMode, AloneMode, config.CrowdsecMode)
+	}
+	if config.CrowdsecMode != AloneMode && config.CrowdsecLapiHost == "" {
+		return fmt.Errorf("crowdsecLapiHost is required")
+	}
+	return nil
+}
+
+// GetVariable resolves a secret-bearing config field by name: if the field itself is set, its
+// value is used as-is; otherwise an environment variable of the same name is consulted. This
+// lets deployments inject API keys and passwords at runtime instead of checking them into the
+// dynamic configuration.
+func GetVariable(config *Config, fieldName string) (string, error) {
+	field := reflect.ValueOf(config).Elem().FieldByName(fieldName)
+	if field.IsValid() && field.Kind() == reflect.String && field.String() != "" {
+		return field.String(), nil
+	}
+	if envValue, ok := os.LookupEnv(fieldName); ok && envValue != "" {
+		return envValue, nil
+	}
+	return "", fmt.Errorf("%s is not set", fieldName)
+}
+
+// GetTLSConfigCrowdsec builds the tls.Config used for LAPI connections, loading the bouncer's
+// client certificate/key when mTLS auth is configured and a custom CA bundle when set.
+func GetTLSConfigCrowdsec(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.CrowdsecLapiTLSInsecureVerify} //nolint:gosec
+
+	if config.CrowdsecLapiTLSCertificateBouncer != "" && config.CrowdsecLapiTLSKeyBouncer != "" {
+		cert, err := tls.LoadX509KeyPair(config.CrowdsecLapiTLSCertificateBouncer, config.CrowdsecLapiTLSKeyBouncer)
+		if err != nil {
+			return nil, fmt.Errorf("getTLSConfigCrowdsec:loadKeyPair %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.CrowdsecLapiTLSCertificateAuthority != "" {
+		caCert, err := os.ReadFile(config.CrowdsecLapiTLSCertificateAuthority)
+		if err != nil {
+			return nil, fmt.Errorf("getTLSConfigCrowdsec:readCertificateAuthority %w", err)
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("getTLSConfigCrowdsec:parseCertificateAuthority invalid PEM in %s", config.CrowdsecLapiTLSCertificateAuthority)
+		}
+		tlsConfig.RootCAs = caPool
+	}
+
+	return tlsConfig, nil
+}
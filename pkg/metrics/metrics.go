@@ -0,0 +1,256 @@
+// Package metrics accumulates Prometheus-compatible counters for a bouncer instance and
+// renders CrowdSec's remote usage-metrics payload from the same data.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+
+	logger "github.com/maxlerebourg/crowdsec-bouncer-traefik-plugin/pkg/logger"
+)
+
+// Possible values of the "decision" label on processed_total.
+const (
+	DecisionAllow   = "allow"
+	DecisionBan     = "ban"
+	DecisionCaptcha = "captcha"
+	DecisionBypass  = "bypass"
+	DecisionError   = "error"
+)
+
+// Registry accumulates the counters for a single bouncer instance.
+type Registry struct {
+	name string
+
+	mu                   sync.Mutex
+	served               bool
+	processedTotal       map[string]int64
+	activeDecisions      map[string]int64
+	lapiRequestsTotal    map[string]int64
+	lapiDurationSum      float64
+	lapiDurationCount    int64
+	streamLastSuccess    int64
+	cacheOperationsTotal map[string]int64
+	pushedProcessed      map[string]int64
+}
+
+//nolint:gochecknoglobals
+var (
+	registriesMu sync.Mutex
+	registries   = map[string]*Registry{}
+)
+
+// Get returns the package-level singleton Registry for a bouncer name, creating it on first
+// use. A Traefik plugin can be instantiated multiple times (once per router), so keying by
+// name keeps those deployments distinguishable instead of clobbering each other's counters.
+func Get(name string) *Registry {
+	registriesMu.Lock()
+	defer registriesMu.Unlock()
+	if r, ok := registries[name]; ok {
+		return r
+	}
+	r := &Registry{
+		name:                 name,
+		processedTotal:       map[string]int64{},
+		activeDecisions:      map[string]int64{},
+		lapiRequestsTotal:    map[string]int64{},
+		cacheOperationsTotal: map[string]int64{},
+	}
+	registries[name] = r
+	return r
+}
+
+// IncProcessed increments processed_total for a request decision.
+func (r *Registry) IncProcessed(decision string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.processedTotal[decision]++
+}
+
+// SetActiveDecisions sets the active_decisions gauge for an origin/scope pair.
+func (r *Registry) SetActiveDecisions(origin, scope string, count int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.activeDecisions[origin+"|"+scope] = count
+}
+
+// IncLapiRequest increments lapi_requests_total for a route/status pair.
+func (r *Registry) IncLapiRequest(route string, status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lapiRequestsTotal[fmt.Sprintf("%s|%d", route, status)]++
+}
+
+// ObserveLapiDuration records a LAPI request's wall-clock duration, in seconds.
+func (r *Registry) ObserveLapiDuration(seconds float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lapiDurationSum += seconds
+	r.lapiDurationCount++
+}
+
+// SetStreamLastSuccess records the unix timestamp of the last successful stream tick.
+func (r *Registry) SetStreamLastSuccess(unixSeconds int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streamLastSuccess = unixSeconds
+}
+
+// IncCacheOperation increments cache_operations_total for an operation/result pair.
+func (r *Registry) IncCacheOperation(op, result string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cacheOperationsTotal[op+"|"+result]++
+}
+
+// WritePrometheus renders every series in Prometheus text exposition format, labeled with this
+// registry's bouncer name.
+func (r *Registry) WritePrometheus(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP crowdsec_bouncer_processed_total Requests processed, by decision.")
+	fmt.Fprintln(w, "# TYPE crowdsec_bouncer_processed_total counter")
+	for decision, count := range r.processedTotal {
+		fmt.Fprintf(w, "crowdsec_bouncer_processed_total{name=%q,decision=%q} %d\n", r.name, decision, count)
+	}
+
+	fmt.Fprintln(w, "# HELP crowdsec_bouncer_active_decisions Decisions currently held in cache, by origin and scope.")
+	fmt.Fprintln(w, "# TYPE crowdsec_bouncer_active_decisions gauge")
+	for key, count := range r.activeDecisions {
+		origin, scope, _ := strings.Cut(key, "|")
+		fmt.Fprintf(w, "crowdsec_bouncer_active_decisions{name=%q,origin=%q,scope=%q} %d\n", r.name, origin, scope, count)
+	}
+
+	fmt.Fprintln(w, "# HELP crowdsec_bouncer_lapi_requests_total LAPI requests, by route and status.")
+	fmt.Fprintln(w, "# TYPE crowdsec_bouncer_lapi_requests_total counter")
+	for key, count := range r.lapiRequestsTotal {
+		route, status, _ := strings.Cut(key, "|")
+		fmt.Fprintf(w, "crowdsec_bouncer_lapi_requests_total{name=%q,route=%q,status=%q} %d\n", r.name, route, status, count)
+	}
+
+	fmt.Fprintln(w, "# HELP crowdsec_bouncer_lapi_request_duration_seconds LAPI request latency.")
+	fmt.Fprintln(w, "# TYPE crowdsec_bouncer_lapi_request_duration_seconds summary")
+	fmt.Fprintf(w, "crowdsec_bouncer_lapi_request_duration_seconds_sum{name=%q} %f\n", r.name, r.lapiDurationSum)
+	fmt.Fprintf(w, "crowdsec_bouncer_lapi_request_duration_seconds_count{name=%q} %d\n", r.name, r.lapiDurationCount)
+
+	fmt.Fprintln(w, "# HELP crowdsec_bouncer_stream_last_success_timestamp Unix timestamp of the last successful stream tick.")
+	fmt.Fprintln(w, "# TYPE crowdsec_bouncer_stream_last_success_timestamp gauge")
+	fmt.Fprintf(w, "crowdsec_bouncer_stream_last_success_timestamp{name=%q} %d\n", r.name, r.streamLastSuccess)
+
+	fmt.Fprintln(w, "# HELP crowdsec_bouncer_cache_operations_total Cache operations, by op and result.")
+	fmt.Fprintln(w, "# TYPE crowdsec_bouncer_cache_operations_total counter")
+	for key, count := range r.cacheOperationsTotal {
+		op, result, _ := strings.Cut(key, "|")
+		fmt.Fprintf(w, "crowdsec_bouncer_cache_operations_total{name=%q,op=%q,result=%q} %d\n", r.name, op, result, count)
+	}
+}
+
+// Serve starts a plain-text Prometheus scrape endpoint on addr, in its own goroutine. Since
+// Get returns a singleton keyed by bouncer name, and a Traefik plugin can be instantiated
+// several times (e.g. once per router), Serve is a no-op past the first call for a given
+// Registry so multiple instances don't each try to bind and ListenAndServe the same port.
+func (r *Registry) Serve(addr, path string) {
+	r.mu.Lock()
+	if r.served {
+		r.mu.Unlock()
+		return
+	}
+	r.served = true
+	r.mu.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WritePrometheus(w)
+	})
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil { //nolint:gosec
+			logger.Error(fmt.Sprintf("metrics:serve addr:%s %s", addr, err.Error()))
+		}
+	}()
+}
+
+// UsageMetricsPayload mirrors the JSON schema expected by LAPI's /v1/usage-metrics route.
+type UsageMetricsPayload struct {
+	RemediationComponents []RemediationComponent `json:"remediation_components"`
+}
+
+// RemediationComponent describes this bouncer instance in a usage-metrics push.
+type RemediationComponent struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Version  string   `json:"version"`
+	OS       OS       `json:"os"`
+	Features []string `json:"feature_flags"`
+	Metrics  []Metric `json:"metrics"`
+}
+
+// OS identifies the platform the bouncer is running on.
+type OS struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Metric is one aggregation window of MetricItem values.
+type Metric struct {
+	Meta  MetricMeta   `json:"meta"`
+	Items []MetricItem `json:"items"`
+}
+
+// MetricMeta describes the aggregation window a Metric's items were collected over.
+type MetricMeta struct {
+	WindowSizeSeconds int64 `json:"window_size_seconds"`
+}
+
+// MetricItem is a single aggregated counter reported to LAPI.
+type MetricItem struct {
+	Name   string            `json:"name"`
+	Value  float64           `json:"value"`
+	Unit   string            `json:"unit"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// BuildUsagePayload aggregates the counters collected over the reporting window into the
+// JSON schema CrowdSec expects from remote_metrics pushes.
+func (r *Registry) BuildUsagePayload(version string, windowSeconds int64, features []string) *UsageMetricsPayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pushedProcessed == nil {
+		r.pushedProcessed = map[string]int64{}
+	}
+	items := make([]MetricItem, 0, len(r.processedTotal))
+	for decision, count := range r.processedTotal {
+		delta := count - r.pushedProcessed[decision]
+		r.pushedProcessed[decision] = count
+		items = append(items, MetricItem{
+			Name:   "processed_total",
+			Value:  float64(delta),
+			Unit:   "request",
+			Labels: map[string]string{"decision": decision},
+		})
+	}
+
+	return &UsageMetricsPayload{
+		RemediationComponents: []RemediationComponent{
+			{
+				Name:     r.name,
+				Type:     "crowdsec-bouncer-traefik-plugin",
+				Version:  version,
+				OS:       OS{Name: runtime.GOOS, Version: runtime.GOARCH},
+				Features: features,
+				Metrics: []Metric{
+					{
+						Meta:  MetricMeta{WindowSizeSeconds: windowSeconds},
+						Items: items,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestIncProcessedIncrementsPerDecision(t *testing.T) {
+	r := &Registry{
+		name:                 "test",
+		processedTotal:       map[string]int64{},
+		activeDecisions:      map[string]int64{},
+		lapiRequestsTotal:    map[string]int64{},
+		cacheOperationsTotal: map[string]int64{},
+	}
+
+	r.IncProcessed(DecisionBan)
+	r.IncProcessed(DecisionBan)
+	r.IncProcessed(DecisionCaptcha)
+	r.IncProcessed(DecisionBypass)
+
+	if r.processedTotal[DecisionBan] != 2 {
+		t.Fatalf("expected 2 ban decisions, got %d", r.processedTotal[DecisionBan])
+	}
+	if r.processedTotal[DecisionCaptcha] != 1 {
+		t.Fatalf("expected 1 captcha decision, got %d", r.processedTotal[DecisionCaptcha])
+	}
+	if r.processedTotal[DecisionBypass] != 1 {
+		t.Fatalf("expected 1 bypass decision, got %d", r.processedTotal[DecisionBypass])
+	}
+}
+
+func TestServeIsIdempotentPerRegistry(t *testing.T) {
+	r := Get("test-serve-idempotent")
+	r.Serve(":0", "/metrics")
+	firstServed := r.served
+	r.Serve(":0", "/metrics")
+	if !firstServed || !r.served {
+		t.Fatalf("expected Serve to mark the registry as served")
+	}
+	// A second Serve call on an already-served registry must be a no-op: the only externally
+	// observable symptom of a regression here is a second http.ListenAndServe bind attempt,
+	// which is exactly what the `served` guard exists to prevent.
+}
+
+func TestBuildUsagePayloadRoundTrips(t *testing.T) {
+	r := &Registry{
+		name:                 "test-bouncer",
+		processedTotal:       map[string]int64{DecisionAllow: 10, DecisionBan: 3},
+		activeDecisions:      map[string]int64{},
+		lapiRequestsTotal:    map[string]int64{},
+		cacheOperationsTotal: map[string]int64{},
+	}
+
+	payload := r.BuildUsagePayload("dev", 60, []string{"live"})
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var decoded UsageMetricsPayload
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if len(decoded.RemediationComponents) != 1 {
+		t.Fatalf("expected 1 remediation component, got %d", len(decoded.RemediationComponents))
+	}
+	component := decoded.RemediationComponents[0]
+	if component.Name != "test-bouncer" || component.Version != "dev" {
+		t.Fatalf("expected name/version to round-trip, got %+v", component)
+	}
+	if len(component.Metrics) != 1 || component.Metrics[0].Meta.WindowSizeSeconds != 60 {
+		t.Fatalf("expected one metric window of 60s, got %+v", component.Metrics)
+	}
+
+	foundAllow, foundBan := false, false
+	for _, item := range component.Metrics[0].Items {
+		if item.Name != "processed_total" {
+			continue
+		}
+		switch item.Labels["decision"] {
+		case DecisionAllow:
+			foundAllow = item.Value == 10
+		case DecisionBan:
+			foundBan = item.Value == 3
+		}
+	}
+	if !foundAllow || !foundBan {
+		t.Fatalf("expected processed_total items for allow:10 and ban:3, got %+v", component.Metrics[0].Items)
+	}
+}